@@ -0,0 +1,76 @@
+package modules
+
+import (
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// RevisionActionType identifies the kind of edit a RevisionAction makes to
+// a storage obligation's sector roots during the host's revision loop.
+type RevisionActionType string
+
+// The kinds of edits that a RevisionAction can make to a file contract's
+// sector roots.
+const (
+	// ActionDelete removes the sector at SectorIndex from the contract.
+	ActionDelete = RevisionActionType("Delete")
+
+	// ActionInsert adds Data as a new sector at SectorIndex, shifting any
+	// sector already at or after that index back by one.
+	ActionInsert = RevisionActionType("Insert")
+
+	// ActionModify overwrites the sector at SectorIndex with Data at
+	// Offset.
+	ActionModify = RevisionActionType("Modify")
+
+	// ActionModifyRange overwrites a single crypto.SegmentSize leaf of the
+	// sector at SectorIndex with Data at Offset. It is authorized by the
+	// Merkle proof and previous leaf contents sent alongside the
+	// RevisionAction in a matching RangeProof.
+	ActionModifyRange = RevisionActionType("ModifyRange")
+)
+
+// RevisionAction specifies a single edit to be performed on a file
+// contract's sector roots as part of a batch of modifications sent during
+// the revision loop.
+type RevisionAction struct {
+	Type        RevisionActionType
+	SectorIndex uint64
+	Offset      uint64
+	Data        []byte
+}
+
+// RangeProof accompanies an ActionModifyRange RevisionAction, supplying the
+// Merkle proof and previous leaf contents needed to verify the edit against
+// the sector's current root. The host still reads the full sector off of
+// disk to apply the edit and recompute the sector root. Every
+// ActionModifyRange in a revision batch has a corresponding RangeProof, in
+// the same relative order.
+type RangeProof struct {
+	MerkleProof []crypto.Hash
+	OldData     []byte
+}
+
+// DownloadAction specifies a single byte range to be read from an existing
+// sector as part of a batch of download requests sent during the download
+// loop.
+type DownloadAction struct {
+	SectorIndex uint64
+	Offset      uint64
+	Length      uint64
+}
+
+// HostInternalSettings are the settings that govern how the host prices and
+// limits the revision and download loops. Unlike the settings the host
+// announces to the network, these only constrain what the host package
+// itself will accept from a renter.
+type HostInternalSettings struct {
+	Collateral types.Currency
+
+	MaxReviseBatchSize   uint64
+	MaxDownloadBatchSize uint64
+
+	MinimumDownloadBandwidthPrice types.Currency
+	MinimumStoragePrice           types.Currency
+	MinimumUploadBandwidthPrice   types.Currency
+}
@@ -0,0 +1,195 @@
+package host
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+var (
+	// errBadDownloadIndex is returned if the renter requests a download on a
+	// sector root that is not in the file contract.
+	errBadDownloadIndex = errors.New("renter has requested a download that points to a nonexistant sector")
+
+	// errDownloadIllegalOffsetAndLength is returned if the renter requests a
+	// byte range that extends beyond the bounds of the sector.
+	errDownloadIllegalOffsetAndLength = errors.New("renter is trying to download using an illegal offset and length")
+)
+
+// checkDownloadOffsetAndLength checks that a requested byte range falls
+// within a single sector. length is bounded by SectorSize-offset instead
+// of checking offset+length against SectorSize, since the latter sum can
+// wrap around and pass the check even for an out-of-bounds request.
+func checkDownloadOffsetAndLength(offset, length uint64) error {
+	if offset > modules.SectorSize || length > modules.SectorSize-offset {
+		return errDownloadIllegalOffsetAndLength
+	}
+	return nil
+}
+
+// managedDownloadIteration handles one iteration of the download loop. As a
+// performance optimization, multiple iterations of downloads are allowed to
+// be made over the same connection, and a single iteration may request
+// multiple byte ranges across multiple sectors.
+func (h *Host) managedDownloadIteration(conn net.Conn, so *storageObligation) error {
+	// Send the settings to the renter. The host will keep going even if it
+	// is not accepting contracts, because in this case the contract already
+	// exists.
+	err := h.managedRPCSettings(conn)
+	if err != nil {
+		return err
+	}
+
+	// Set the negotiation deadline.
+	conn.SetDeadline(time.Now().Add(modules.NegotiateFileContractRevisionTime))
+
+	// The renter will either accept or reject the settings + revision
+	// transaction. It may also return a stop response to indicate that it
+	// wishes to terminate the download loop.
+	err = modules.ReadNegotiationAcceptance(conn)
+	if err != nil {
+		return err
+	}
+
+	// Read some variables from the host for use later in the function.
+	h.mu.RLock()
+	settings := h.settings
+	secretKey := h.secretKey
+	blockHeight := h.blockHeight
+	h.mu.RUnlock()
+
+	// The renter is now going to send a batch of download requests, followed
+	// by an updated file contract revision that pays for the bandwidth of
+	// those requests.
+	var requests []modules.DownloadAction
+	err = encoding.ReadObject(conn, &requests, settings.MaxDownloadBatchSize)
+	if err != nil {
+		return err
+	}
+
+	// Fetch the requested ranges and tally up the bandwidth revenue that the
+	// renter owes the host for fulfilling them.
+	var bandwidthRevenue types.Currency
+	var sectorData [][]byte
+	renterFunds := so.recentRevision().NewValidProofOutputs[0].Value
+	err = func() error {
+		for _, request := range requests {
+			// Check that the index points to an existing sector root.
+			if request.SectorIndex >= uint64(len(so.SectorRoots)) {
+				return errBadDownloadIndex
+			}
+			if err := checkDownloadOffsetAndLength(request.Offset, request.Length); err != nil {
+				return err
+			}
+
+			sector, err := h.readSector(so.SectorRoots[request.SectorIndex])
+			if err != nil {
+				return err
+			}
+			sectorData = append(sectorData, sector[request.Offset:request.Offset+request.Length])
+
+			// Update finances, making sure the renter is not charged more
+			// than it has remaining in the contract's valid proof output.
+			bandwidthRevenue = bandwidthRevenue.Add(settings.MinimumDownloadBandwidthPrice.Mul(types.NewCurrency64(request.Length)))
+			if bandwidthRevenue.Cmp(renterFunds) > 0 {
+				return errInsufficientRenterFunds
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return modules.WriteNegotiationRejection(conn, err)
+	}
+
+	// Read the file contract revision and check whether it pays for the
+	// bandwidth that was just used.
+	var revision types.FileContractRevision
+	err = encoding.ReadObject(conn, &revision, 16e3)
+	if err != nil {
+		return err
+	}
+	err = verifyRevision(so, revision, types.ZeroCurrency, bandwidthRevenue, types.ZeroCurrency)
+	if err != nil {
+		return modules.WriteNegotiationRejection(conn, err)
+	}
+
+	// Revision is acceptable, write an acceptance string.
+	err = modules.WriteNegotiationAcceptance(conn)
+	if err != nil {
+		return err
+	}
+
+	// Renter will now send the transaction signatures for the file contract
+	// revision.
+	var renterSig types.TransactionSignature
+	err = encoding.ReadObject(conn, &renterSig, 16e3)
+	if err != nil {
+		return err
+	}
+	txn, err := h.managedFinalizeRevision(so, revision, renterSig, secretKey, blockHeight, types.ZeroCurrency, bandwidthRevenue, types.ZeroCurrency, nil, nil, nil)
+	if err != nil {
+		return modules.WriteNegotiationRejection(conn, err)
+	}
+
+	// Host will now send acceptance and its signature to the renter, and
+	// then stream the requested sector data back, one chunk per request, so
+	// that a large download does not require reissuing the RPC per sector.
+	err = modules.WriteNegotiationAcceptance(conn)
+	if err != nil {
+		return err
+	}
+	err = encoding.WriteObject(conn, txn.TransactionSignatures[1])
+	if err != nil {
+		return err
+	}
+	for _, data := range sectorData {
+		err = encoding.WriteObject(conn, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// managedRPCDownload accepts a request to download data from an existing
+// file contract, paid for by revising the contract in the same way that
+// uploads are paid for.
+func (h *Host) managedRPCDownload(conn net.Conn) error {
+	// Set a preliminary deadline for receiving the storage obligation.
+	startTime := time.Now()
+	// Perform the file contract revision exchange, giving the renter the
+	// most recent file contract revision and getting the storage obligation
+	// that will be used to pay for the data.
+	_, so, err := h.managedRPCRecentRevision(conn)
+	if err != nil {
+		return err
+	}
+
+	// Lock the storage obligation during the download.
+	err = h.lockStorageObligation(so)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = h.unlockStorageObligation(so)
+		if err != nil {
+			h.log.Critical(err)
+		}
+	}()
+
+	// Begin the download loop. The host will process download requests until
+	// a timeout is reached, or until the renter sends a StopResponse.
+	for time.Now().Before(startTime.Add(1200 * time.Second)) {
+		err := h.managedDownloadIteration(conn, so)
+		if err == modules.ErrStopResponse {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package host
+
+import (
+	"testing"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// TestCheckDownloadOffsetAndLength checks that a byte range is accepted
+// only when it falls entirely within a single sector, and in particular
+// that an offset and length whose sum overflows uint64 cannot slip past
+// the check.
+func TestCheckDownloadOffsetAndLength(t *testing.T) {
+	tests := []struct {
+		offset, length uint64
+		wantErr        bool
+	}{
+		{0, modules.SectorSize, false},
+		{modules.SectorSize - 1, 1, false},
+		{0, modules.SectorSize + 1, true},
+		{modules.SectorSize + 1, 1, true},
+		{modules.SectorSize - 1, 2, true},
+		// An offset and length that would overflow if summed directly.
+		{^uint64(0), 2, true},
+	}
+	for _, tt := range tests {
+		err := checkDownloadOffsetAndLength(tt.offset, tt.length)
+		if tt.wantErr && err != errDownloadIllegalOffsetAndLength {
+			t.Errorf("offset %v length %v: expected errDownloadIllegalOffsetAndLength, got %v", tt.offset, tt.length, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("offset %v length %v: expected no error, got %v", tt.offset, tt.length, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package host
+
+import (
+	"errors"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// errBadRangeProof is returned if the renter supplies a Merkle proof that
+// does not verify against the sector root the host has on record.
+var errBadRangeProof = errors.New("renter has supplied a Merkle proof that does not match the sector root")
+
+// applyLeafProof checks that oldLeaf, combined with proof, hashes up to
+// root, and if so returns the root that would result from replacing oldLeaf
+// with newLeaf at the same position. proof is ordered from the leaf's
+// sibling up to the root, the same order used when the leaves are counted
+// off in crypto.SegmentSize chunks to build a sector's Merkle root. This
+// lets the host apply a small edit and recompute the sector root without
+// reading the rest of the sector off of disk.
+func applyLeafProof(root crypto.Hash, proof []crypto.Hash, leafIndex, numLeaves uint64, oldLeaf, newLeaf []byte) (crypto.Hash, error) {
+	if leafIndex >= numLeaves {
+		return crypto.Hash{}, errBadModificationIndex
+	}
+
+	oldRoot, err := climbLeafProof(proof, leafIndex, leafSum(oldLeaf))
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	if oldRoot != root {
+		return crypto.Hash{}, errBadRangeProof
+	}
+	return climbLeafProof(proof, leafIndex, leafSum(newLeaf))
+}
+
+// climbLeafProof recomputes the root that results from combining a leaf
+// hash with the sibling hashes in proof, walking up the tree one level per
+// entry in proof.
+func climbLeafProof(proof []crypto.Hash, leafIndex uint64, leaf crypto.Hash) (crypto.Hash, error) {
+	cur := leaf
+	for _, sibling := range proof {
+		if leafIndex%2 == 0 {
+			cur = nodeSum(cur, sibling)
+		} else {
+			cur = nodeSum(sibling, cur)
+		}
+		leafIndex /= 2
+	}
+	return cur, nil
+}
+
+// leafSum and nodeSum mirror the domain-separated hashing that crypto uses
+// internally when building a Merkle tree out of crypto.SegmentSize leaves,
+// so that a root recomputed here agrees with the one crypto.MerkleRoot
+// would produce for the same sector.
+func leafSum(data []byte) crypto.Hash {
+	return crypto.HashBytes(append([]byte{0}, data...))
+}
+
+func nodeSum(left, right crypto.Hash) crypto.Hash {
+	return crypto.HashBytes(append(append([]byte{1}, left[:]...), right[:]...))
+}
+
+// applyRangeEdit verifies proof against sector's current root and, if it
+// checks out, overwrites the targeted leaf in sector with newLeaf and
+// returns the sector's new Merkle root. sector is the full, independently
+// read copy of the content addressed by oldRoot (as h.readSector returns);
+// the caller commits the result the same way any other full-sector edit is
+// committed, by adding the new sector and removing the old one by hash, so
+// that two indices in so.SectorRoots which happen to share oldRoot are
+// never aliased through shared on-disk state.
+func applyRangeEdit(oldRoot crypto.Hash, proof modules.RangeProof, leafIndex, numLeaves uint64, sector, newLeaf []byte) (crypto.Hash, error) {
+	if _, err := applyLeafProof(oldRoot, proof.MerkleProof, leafIndex, numLeaves, proof.OldData, newLeaf); err != nil {
+		return crypto.Hash{}, err
+	}
+	copy(sector[leafIndex*crypto.SegmentSize:], newLeaf)
+	return crypto.MerkleRoot(sector), nil
+}
@@ -0,0 +1,198 @@
+package host
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// buildLeafProof constructs the Merkle proof for the leaf at leafIndex in a
+// tree built from leaves, along with the tree's root, mirroring the
+// leaf/node hashing that applyLeafProof and climbLeafProof expect.
+func buildLeafProof(leaves [][]byte, leafIndex uint64) (crypto.Hash, []crypto.Hash) {
+	level := make([]crypto.Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = leafSum(leaf)
+	}
+
+	var proof []crypto.Hash
+	index := leafIndex
+	for len(level) > 1 {
+		if index^1 < uint64(len(level)) {
+			proof = append(proof, level[index^1])
+		}
+		var next []crypto.Hash
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, nodeSum(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		level = next
+		index /= 2
+	}
+	return level[0], proof
+}
+
+// TestApplyLeafProof checks that applyLeafProof accepts a valid proof and
+// returns the root that results from replacing the old leaf with the new
+// one.
+func TestApplyLeafProof(t *testing.T) {
+	leaves := [][]byte{
+		bytes.Repeat([]byte{0}, crypto.SegmentSize),
+		bytes.Repeat([]byte{1}, crypto.SegmentSize),
+		bytes.Repeat([]byte{2}, crypto.SegmentSize),
+		bytes.Repeat([]byte{3}, crypto.SegmentSize),
+	}
+	const leafIndex = 1
+	root, proof := buildLeafProof(leaves, leafIndex)
+
+	newLeaf := bytes.Repeat([]byte{0xff}, crypto.SegmentSize)
+	newRoot, err := applyLeafProof(root, proof, leafIndex, uint64(len(leaves)), leaves[leafIndex], newLeaf)
+	if err != nil {
+		t.Fatal("expected a valid proof to be accepted, got", err)
+	}
+
+	wantLeaves := make([][]byte, len(leaves))
+	copy(wantLeaves, leaves)
+	wantLeaves[leafIndex] = newLeaf
+	wantRoot, _ := buildLeafProof(wantLeaves, leafIndex)
+	if newRoot != wantRoot {
+		t.Fatalf("applyLeafProof returned the wrong root: got %v, want %v", newRoot, wantRoot)
+	}
+}
+
+// TestApplyLeafProofRejectsBadProof checks that applyLeafProof rejects a
+// proof that does not hash up to the claimed sector root because the old
+// leaf contents supplied with it are wrong.
+func TestApplyLeafProofRejectsBadProof(t *testing.T) {
+	leaves := [][]byte{
+		bytes.Repeat([]byte{0}, crypto.SegmentSize),
+		bytes.Repeat([]byte{1}, crypto.SegmentSize),
+	}
+	const leafIndex = 0
+	root, proof := buildLeafProof(leaves, leafIndex)
+
+	wrongOldLeaf := bytes.Repeat([]byte{0x42}, crypto.SegmentSize)
+	newLeaf := bytes.Repeat([]byte{0xff}, crypto.SegmentSize)
+	_, err := applyLeafProof(root, proof, leafIndex, uint64(len(leaves)), wrongOldLeaf, newLeaf)
+	if err != errBadRangeProof {
+		t.Fatal("expected errBadRangeProof for a forged old leaf, got", err)
+	}
+}
+
+// TestApplyLeafProofRejectsOutOfBoundsLeaf checks that applyLeafProof
+// rejects a leaf index that falls outside the sector.
+func TestApplyLeafProofRejectsOutOfBoundsLeaf(t *testing.T) {
+	leaves := [][]byte{
+		bytes.Repeat([]byte{0}, crypto.SegmentSize),
+		bytes.Repeat([]byte{1}, crypto.SegmentSize),
+	}
+	root, proof := buildLeafProof(leaves, 0)
+	newLeaf := bytes.Repeat([]byte{0xff}, crypto.SegmentSize)
+	_, err := applyLeafProof(root, proof, uint64(len(leaves)), uint64(len(leaves)), leaves[0], newLeaf)
+	if err != errBadModificationIndex {
+		t.Fatal("expected errBadModificationIndex for an out-of-bounds leaf, got", err)
+	}
+}
+
+// rangeProofFor builds a modules.RangeProof and the claimed old root for
+// editing the leaf at leafIndex within sector.
+func rangeProofFor(sector []byte, leafIndex, numLeaves uint64) (crypto.Hash, modules.RangeProof) {
+	leaves := make([][]byte, numLeaves)
+	for i := range leaves {
+		leaves[i] = sector[i*crypto.SegmentSize : (i+1)*crypto.SegmentSize]
+	}
+	root, proof := buildLeafProof(leaves, leafIndex)
+	return root, modules.RangeProof{
+		MerkleProof: proof,
+		OldData:     leaves[leafIndex],
+	}
+}
+
+// TestApplyRangeEdit checks that applyRangeEdit verifies the supplied
+// proof against the sector's current root and, if it checks out,
+// overwrites the targeted leaf and returns the resulting sector's new
+// Merkle root.
+func TestApplyRangeEdit(t *testing.T) {
+	const numLeaves = 4
+	sector := bytes.Repeat([]byte{0xab}, numLeaves*crypto.SegmentSize)
+	const leafIndex = 2
+	oldRoot, proof := rangeProofFor(sector, leafIndex, numLeaves)
+
+	newLeaf := bytes.Repeat([]byte{0xcd}, crypto.SegmentSize)
+	newRoot, err := applyRangeEdit(oldRoot, proof, leafIndex, numLeaves, sector, newLeaf)
+	if err != nil {
+		t.Fatal("expected a valid proof to be accepted, got", err)
+	}
+	if got := crypto.MerkleRoot(sector); got != newRoot {
+		t.Fatalf("applyRangeEdit returned a root that doesn't match the edited sector: got %v, want %v", newRoot, got)
+	}
+	if !bytes.Equal(sector[leafIndex*crypto.SegmentSize:(leafIndex+1)*crypto.SegmentSize], newLeaf) {
+		t.Fatal("applyRangeEdit did not write newLeaf into the sector")
+	}
+}
+
+// TestApplyRangeEditRejectsBadProof checks that applyRangeEdit rejects an
+// edit whose proof does not verify against the sector's current root
+// before it touches the sector bytes.
+func TestApplyRangeEditRejectsBadProof(t *testing.T) {
+	const numLeaves = 2
+	sector := bytes.Repeat([]byte{0xab}, numLeaves*crypto.SegmentSize)
+	const leafIndex = 0
+	oldRoot, proof := rangeProofFor(sector, leafIndex, numLeaves)
+	proof.OldData = bytes.Repeat([]byte{0x42}, crypto.SegmentSize)
+
+	original := append([]byte(nil), sector...)
+	newLeaf := bytes.Repeat([]byte{0xcd}, crypto.SegmentSize)
+	_, err := applyRangeEdit(oldRoot, proof, leafIndex, numLeaves, sector, newLeaf)
+	if err != errBadRangeProof {
+		t.Fatal("expected errBadRangeProof for a forged old leaf, got", err)
+	}
+	if !bytes.Equal(sector, original) {
+		t.Fatal("applyRangeEdit must not modify the sector when the proof is rejected")
+	}
+}
+
+// TestApplyRangeEditDoesNotAliasSharedSectors guards against the bug in an
+// earlier version of ActionModifyRange's commit path, which patched a
+// sector's on-disk file in place and renamed it to the new root: if
+// so.SectorRoots held the same root at two indices (trivial to arrange by
+// uploading the same content twice), editing one index renamed the file
+// out from under the other. The current path instead calls applyRangeEdit
+// on each index's own independently read copy and commits the result
+// through the same add/remove-by-hash path as ActionModify, so two
+// indices that happen to share a root are never aliased through shared
+// on-disk state.
+func TestApplyRangeEditDoesNotAliasSharedSectors(t *testing.T) {
+	const numLeaves = 4
+	original := bytes.Repeat([]byte{0xab}, numLeaves*crypto.SegmentSize)
+	sharedRoot := crypto.MerkleRoot(original)
+
+	// Simulate two indices in so.SectorRoots that reference the same
+	// content hash; each read of that hash returns its own copy of the
+	// bytes, the same way h.readSector does.
+	sectorA := append([]byte(nil), original...)
+	sectorB := append([]byte(nil), original...)
+
+	const leafIndex = 1
+	_, proof := rangeProofFor(sectorA, leafIndex, numLeaves)
+	newLeaf := bytes.Repeat([]byte{0xcd}, crypto.SegmentSize)
+	newRootA, err := applyRangeEdit(sharedRoot, proof, leafIndex, numLeaves, sectorA, newLeaf)
+	if err != nil {
+		t.Fatal("expected a valid proof to be accepted, got", err)
+	}
+
+	if newRootA == sharedRoot {
+		t.Fatal("editing sectorA should have produced a different root")
+	}
+	if !bytes.Equal(sectorB, original) {
+		t.Fatal("editing sectorA's independent copy corrupted sectorB's copy")
+	}
+	if crypto.MerkleRoot(sectorB) != sharedRoot {
+		t.Fatal("sectorB's root changed even though it was never edited")
+	}
+}
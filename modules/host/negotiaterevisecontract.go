@@ -1,13 +1,5 @@
 package host
 
-// TODO: Since we're gathering untrusted input, need to check for both
-// overflows and nil values.
-
-// TODO: Does the host properly account for the cost of uploading or
-// downloading data? Sectors gained is not going to be good enough, because
-// it's going to contain a whole sector even though the amount of storage is
-// not changing and the amount of bandwidth is mostly minimal.
-
 import (
 	"errors"
 	"net"
@@ -40,6 +32,98 @@ var (
 	// errUnknownModification is returned if the host receives a modification
 	// action from the renter that it does not understand.
 	errUnknownModification = errors.New("renter is attempting an action that the host is not aware of")
+
+	// errExpiredProofDeadline is returned if the storage obligation's proof
+	// deadline has already passed, which would cause the number of blocks
+	// remaining on the contract to underflow.
+	errExpiredProofDeadline = errors.New("storage obligation's proof deadline has already passed")
+
+	// errInsufficientRenterFunds is returned if a batch of modifications
+	// would charge the renter more than the renter has remaining in the
+	// contract's valid proof output.
+	errInsufficientRenterFunds = errors.New("renter does not have enough funds remaining in the contract to pay for this batch of modifications")
+
+	// errTooManySectorInserts is returned if a batch of modifications would
+	// insert more sectors than fit within the host's maximum revision batch
+	// size.
+	errTooManySectorInserts = errors.New("renter has tried to insert more sectors than the host's batch size allows")
+
+	// errBadContractParent is returned if the renter's revision has a parent
+	// id that does not match the storage obligation being revised.
+	errBadContractParent = errors.New("file contract revision has a parent id that does not match the storage obligation being revised")
+
+	// errBadFileMerkleRoot is returned if the renter's revision has a Merkle
+	// root that does not match the sector roots of the storage obligation.
+	errBadFileMerkleRoot = errors.New("file contract revision has a bad new Merkle root")
+
+	// errBadFileSize is returned if the renter's revision has a file size
+	// that does not match the sector roots of the storage obligation.
+	errBadFileSize = errors.New("file contract revision has a bad new file size")
+
+	// errBadPayoutUnlockHashes is returned if the renter's revision has
+	// changed the unlock hash of one of the valid or missed payouts.
+	errBadPayoutUnlockHashes = errors.New("file contract revision has altered the payout unlock hashes")
+
+	// errBadRevisionNumber is returned if the renter's revision does not have
+	// a revision number that is strictly greater than the most recent
+	// revision number.
+	errBadRevisionNumber = errors.New("file contract revision does not have a high enough revision number")
+
+	// errBadUnlockConditions is returned if the renter's revision has
+	// unlock conditions that do not match the storage obligation.
+	errBadUnlockConditions = errors.New("file contract revision has bad unlock conditions")
+
+	// errBadUnlockHash is returned if the renter's revision has an unlock
+	// hash that does not match the most recent revision.
+	errBadUnlockHash = errors.New("file contract revision has a bad new unlock hash")
+
+	// errBadWindowEnd is returned if the renter's revision has changed the
+	// window end from the most recent revision.
+	errBadWindowEnd = errors.New("file contract revision has a bad new window end")
+
+	// errBadWindowStart is returned if the renter's revision has changed the
+	// window start from the most recent revision.
+	errBadWindowStart = errors.New("file contract revision has a bad new window start")
+
+	// errInsaneFileContractRevisionOutputCounts is returned if a file
+	// contract revision does not have two valid proof outputs and three
+	// missed proof outputs.
+	errInsaneFileContractRevisionOutputCounts = errors.New("file contract revision has the wrong number of valid or missed proof outputs")
+
+	// errHighRenterMissedOutput is returned if the renter's missed payout is
+	// not drained by the amount that the host is expecting to be paid.
+	errHighRenterMissedOutput = errors.New("file contract revision has a renter missed payout that is too high")
+
+	// errHighRenterValidOutput is returned if the renter's valid payout is
+	// not drained by the amount that the host is expecting to be paid.
+	errHighRenterValidOutput = errors.New("file contract revision has a renter valid payout that is too high")
+
+	// errLowHostMissedOutput is returned if the host's missed payout does not
+	// reflect the collateral that the host is risking on this revision.
+	errLowHostMissedOutput = errors.New("file contract revision has a host missed payout that is too low")
+
+	// errLowHostValidOutput is returned if the host's valid payout does not
+	// reflect the revenue that the host is owed for this revision.
+	errLowHostValidOutput = errors.New("file contract revision has a host valid payout that is too low")
+
+	// errLowVoidOutput is returned if the void missed payout does not
+	// reflect the collateral that the host is risking on this revision.
+	errLowVoidOutput = errors.New("file contract revision has a void payout that is too low")
+
+	// errRenterValidFundsExhausted is returned if the revenue that the
+	// modifications charge the renter exceeds what the renter has left in
+	// the contract's valid proof output.
+	errRenterValidFundsExhausted = errors.New("renter does not have enough funds remaining in its valid proof output to pay for this revision")
+
+	// errRenterMissedFundsExhausted is returned if the revenue that the
+	// modifications charge the renter exceeds what the renter has left in
+	// the contract's missed proof output.
+	errRenterMissedFundsExhausted = errors.New("renter does not have enough funds remaining in its missed proof output to pay for this revision")
+
+	// errHostCollateralExhausted is returned if the collateral that the
+	// modifications risk exceeds what the host has left to lose in the
+	// contract's missed proof output.
+	errHostCollateralExhausted = errors.New("host does not have enough collateral remaining in its missed proof output for this revision")
 )
 
 // managedRevisionIteration handles one iteration of the revision loop. As a
@@ -81,6 +165,15 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 		return err
 	}
 
+	// For every ActionModifyRange in the batch, the renter also sends the
+	// Merkle proof and old leaf data needed to verify and apply it, in the
+	// same order the corresponding ActionModifyRange entries appear above.
+	var rangeProofs []modules.RangeProof
+	err = encoding.ReadObject(conn, &rangeProofs, settings.MaxReviseBatchSize)
+	if err != nil {
+		return err
+	}
+
 	// First read all of the modifications. Then make the modifications, but
 	// with the ability to reverse them. Then verify the the file contract
 	// revision that comes down the line.
@@ -90,6 +183,18 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 	var sectorsRemoved []crypto.Hash
 	var sectorsGained []crypto.Hash
 	var gainedSectorData [][]byte
+	// renterFunds bounds how much revenue this batch is allowed to charge,
+	// since the renter cannot be charged more than it has left in the
+	// contract's valid proof output. collateralRisked is not compared with
+	// renterFunds; it is checked against the host's missed proof output in
+	// verifyRevisionPayouts.
+	renterFunds := so.recentRevision().NewValidProofOutputs[0].Value
+	// maxInsertedSectors bounds the number of ActionInsert operations a
+	// single batch may perform, so that so.SectorRoots cannot grow without
+	// bound within one batch.
+	maxInsertedSectors := settings.MaxReviseBatchSize / modules.SectorSize
+	var insertedSectors uint64
+	var rangeProofIndex int
 	err = func() error {
 		for _, modification := range modifications {
 			// Check that the index points to an existing sector root. If the type
@@ -117,13 +222,26 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 				if uint64(len(modification.Data)) != modules.SectorSize {
 					return errBadSectorSize
 				}
+				// Check that this batch has not inserted more sectors than
+				// the host's batch size allows.
+				insertedSectors++
+				if insertedSectors > maxInsertedSectors {
+					return errTooManySectorInserts
+				}
 
-				// Update finances.
+				// Update finances. The proof deadline is checked first so
+				// that the subtraction below cannot underflow.
+				if blockHeight > so.proofDeadline() {
+					return errExpiredProofDeadline
+				}
 				blocksRemaining := so.proofDeadline() - blockHeight
 				blockBytesCurrency := types.NewCurrency64(uint64(blocksRemaining)).Mul(types.NewCurrency64(modules.SectorSize))
 				bandwidthRevenue = bandwidthRevenue.Add(settings.MinimumUploadBandwidthPrice.Mul(types.NewCurrency64(modules.SectorSize)))
 				storageRevenue = storageRevenue.Add(settings.MinimumStoragePrice.Mul(blockBytesCurrency))
 				collateralRisked = collateralRisked.Add(settings.Collateral.Mul(blockBytesCurrency))
+				if bandwidthRevenue.Add(storageRevenue).Cmp(renterFunds) > 0 {
+					return errInsufficientRenterFunds
+				}
 
 				// Insert the sector into the root list.
 				newRoot := crypto.MerkleRoot(modification.Data)
@@ -131,11 +249,11 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 				gainedSectorData = append(gainedSectorData, modification.Data)
 				so.SectorRoots = append(so.SectorRoots[:modification.SectorIndex], append([]crypto.Hash{newRoot}, so.SectorRoots[modification.SectorIndex:]...)...)
 			} else if modification.Type == modules.ActionModify {
-				// Check that the offset and length are okay. Length is already
-				// known to be appropriately small, but the offset needs to be
-				// checked for being appropriately small as well otherwise there is
-				// a risk of overflow.
-				if modification.Offset > modules.SectorSize || modification.Offset+uint64(len(modification.Data)) > modules.SectorSize {
+				// Check that the offset and length are okay. The comparison
+				// is written as a subtraction rather than an addition so
+				// that a malicious offset and length cannot overflow their
+				// way past the bounds check.
+				if modification.Offset > modules.SectorSize || uint64(len(modification.Data)) > modules.SectorSize-modification.Offset {
 					return errIllegalOffsetAndLength
 				}
 
@@ -148,6 +266,9 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 
 				// Update finances.
 				bandwidthRevenue = bandwidthRevenue.Add(settings.MinimumUploadBandwidthPrice.Mul(types.NewCurrency64(modules.SectorSize)))
+				if bandwidthRevenue.Add(storageRevenue).Cmp(renterFunds) > 0 {
+					return errInsufficientRenterFunds
+				}
 
 				// Update the sectors removed and gained to indicate that the old
 				// sector has been replaced with a new sector.
@@ -156,6 +277,59 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 				sectorsGained = append(sectorsGained, newRoot)
 				gainedSectorData = append(gainedSectorData, sector)
 				so.SectorRoots[modification.SectorIndex] = newRoot
+			} else if modification.Type == modules.ActionModifyRange {
+				// Check that the offset is leaf-aligned and that the data is
+				// exactly one Merkle leaf, so that the leaf written to disk
+				// is the same leaf that the new sector root is computed
+				// from.
+				if modification.Offset%crypto.SegmentSize != 0 || uint64(len(modification.Data)) != crypto.SegmentSize {
+					return errIllegalOffsetAndLength
+				}
+				leafIndex := modification.Offset / crypto.SegmentSize
+				numLeaves := modules.SectorSize / crypto.SegmentSize
+
+				// Each ActionModifyRange consumes the next proof in
+				// rangeProofs; a batch with fewer proofs than
+				// ActionModifyRange entries is malformed.
+				if rangeProofIndex >= len(rangeProofs) {
+					return errBadRangeProof
+				}
+				proof := rangeProofs[rangeProofIndex]
+				rangeProofIndex++
+
+				// Get the data for the new sector. Sectors are
+				// content-addressed, so the same root can appear at more
+				// than one index in so.SectorRoots; applyRangeEdit is
+				// given this index's own independently read copy and the
+				// edit is committed by adding the new sector and removing
+				// the old one by hash, the same way ActionModify does,
+				// rather than mutating a sector's on-disk file in place,
+				// which would corrupt any other index that happens to
+				// share the old root. This costs a full sector read per
+				// edit instead of the single leaf the range-proof design
+				// would otherwise allow, which is the price of keeping
+				// the on-disk store content-addressed.
+				oldRoot := so.SectorRoots[modification.SectorIndex]
+				sector, err := h.readSector(oldRoot)
+				if err != nil {
+					return err
+				}
+				newRoot, err := applyRangeEdit(oldRoot, proof, leafIndex, numLeaves, sector, modification.Data)
+				if err != nil {
+					return err
+				}
+
+				// Update finances. Only the modified leaf is billed for
+				// bandwidth, rather than the full sector.
+				bandwidthRevenue = bandwidthRevenue.Add(settings.MinimumUploadBandwidthPrice.Mul(types.NewCurrency64(uint64(len(modification.Data)))))
+				if bandwidthRevenue.Add(storageRevenue).Cmp(renterFunds) > 0 {
+					return errInsufficientRenterFunds
+				}
+
+				sectorsRemoved = append(sectorsRemoved, oldRoot)
+				sectorsGained = append(sectorsGained, newRoot)
+				gainedSectorData = append(gainedSectorData, sector)
+				so.SectorRoots[modification.SectorIndex] = newRoot
 			} else {
 				return errUnknownModification
 			}
@@ -190,6 +364,30 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 	if err != nil {
 		return err
 	}
+	txn, err := h.managedFinalizeRevision(so, revision, renterSig, secretKey, blockHeight, storageRevenue, bandwidthRevenue, collateralRisked, sectorsRemoved, sectorsGained, gainedSectorData)
+	if err != nil {
+		return modules.WriteNegotiationRejection(conn, err)
+	}
+
+	// Host will now send acceptance and its signature to the renter. This
+	// iteration is complete.
+	err = modules.WriteNegotiationAcceptance(conn)
+	if err != nil {
+		return err
+	}
+	return encoding.WriteObject(conn, txn.TransactionSignatures[1])
+}
+
+// managedFinalizeRevision signs the renter's file contract revision, checks
+// that the resulting transaction is valid, and then commits the revision
+// and the financial changes it represents to the storage obligation. It is
+// shared by every RPC that revises a contract, whether the revision pays for
+// an upload, a download, or some other modification.
+func (h *Host) managedFinalizeRevision(so *storageObligation, revision types.FileContractRevision, renterSig types.TransactionSignature, secretKey crypto.SecretKey, blockHeight types.BlockHeight, storageRevenue, bandwidthRevenue, collateralRisked types.Currency, sectorsRemoved, sectorsGained []crypto.Hash, gainedSectorData [][]byte) (types.Transaction, error) {
+	// Verify that the renter signature is covering the right fields.
+	if renterSig.CoveredFields.WholeTransaction {
+		return types.Transaction{}, errors.New("renter cannot cover the whole transaction")
+	}
 
 	// Create the signatures for a transaction that contains only the file
 	// contract revision and the renter signatures.
@@ -209,7 +407,7 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 	sigHash := txn.SigHash(1)
 	encodedSig, err := crypto.SignHash(sigHash, secretKey)
 	if err != nil {
-		return err
+		return types.Transaction{}, err
 	}
 	txn.TransactionSignatures[1].Signature = encodedSig[:]
 
@@ -217,27 +415,16 @@ func (h *Host) managedRevisionIteration(conn net.Conn, so *storageObligation) er
 	// the host will update and submit the storage obligation.
 	err = txn.StandaloneValid(blockHeight)
 	if err != nil {
-		return modules.WriteNegotiationRejection(conn, err)
-	}
-	// Verify that the renter signature is covering the right fields.
-	if renterSig.CoveredFields.WholeTransaction {
-		return errors.New("renter cannot cover the whole transaction")
+		return types.Transaction{}, err
 	}
 	so.AnticipatedRevenue = so.AnticipatedRevenue.Add(storageRevenue)
 	so.ConfirmedRevenue = so.ConfirmedRevenue.Add(bandwidthRevenue)
 	so.RiskedCollateral = so.RiskedCollateral.Add(collateralRisked)
 	err = h.modifyStorageObligation(so, sectorsRemoved, sectorsGained, gainedSectorData)
 	if err != nil {
-		return modules.WriteNegotiationRejection(conn, err)
+		return types.Transaction{}, err
 	}
-
-	// Host will now send acceptance and its signature to the renter. This
-	// iteration is complete.
-	err = modules.WriteNegotiationAcceptance(conn)
-	if err != nil {
-		return err
-	}
-	return encoding.WriteObject(conn, txn.TransactionSignatures[1])
+	return txn, nil
 }
 
 // managedRPCReviseContract accepts a request to revise an existing contract.
@@ -278,19 +465,115 @@ func (h *Host) managedRPCReviseContract(conn net.Conn) error {
 	return nil
 }
 
-// verifyRevision checks that the revision
-//
-// TODO: Finish implementation
+// verifyRevision checks that the revision that the renter has provided is
+// acceptable, given the previous revision known to the host and the
+// financial changes that the set of modifications are supposed to make.
 func verifyRevision(so *storageObligation, revision types.FileContractRevision, storageRevenue, bandwidthRevenue, collateralRisked types.Currency) error {
-	// Check that all non-volatile fields are the same.
-
-	// Check that the root hash and the file size match the updated sector
-	// roots.
+	// Check that the revision is well-formed before touching any of its
+	// fields.
+	if len(revision.NewValidProofOutputs) != 2 || len(revision.NewMissedProofOutputs) != 3 {
+		return errInsaneFileContractRevisionOutputCounts
+	}
 
-	// Check that the payments have updated to reflect the new revenues.
+	// Fetch the expected file contract revision from the most recent
+	// revision in the storage obligation.
+	oldRevision := so.recentRevision()
+
+	// Check that all of the fields that should not change have not changed.
+	switch {
+	case oldRevision.ParentID != revision.ParentID:
+		return errBadContractParent
+	case oldRevision.UnlockConditions.UnlockHash() != revision.UnlockConditions.UnlockHash():
+		return errBadUnlockConditions
+	case oldRevision.NewWindowStart != revision.NewWindowStart:
+		return errBadWindowStart
+	case oldRevision.NewWindowEnd != revision.NewWindowEnd:
+		return errBadWindowEnd
+	case oldRevision.NewUnlockHash != revision.NewUnlockHash:
+		return errBadUnlockHash
+	case revision.NewValidProofOutputs[0].UnlockHash != oldRevision.NewValidProofOutputs[0].UnlockHash:
+		return errBadPayoutUnlockHashes
+	case revision.NewValidProofOutputs[1].UnlockHash != oldRevision.NewValidProofOutputs[1].UnlockHash:
+		return errBadPayoutUnlockHashes
+	case revision.NewMissedProofOutputs[0].UnlockHash != oldRevision.NewMissedProofOutputs[0].UnlockHash:
+		return errBadPayoutUnlockHashes
+	case revision.NewMissedProofOutputs[1].UnlockHash != oldRevision.NewMissedProofOutputs[1].UnlockHash:
+		return errBadPayoutUnlockHashes
+	case revision.NewMissedProofOutputs[2].UnlockHash != oldRevision.NewMissedProofOutputs[2].UnlockHash:
+		return errBadPayoutUnlockHashes
+	}
 
 	// Check that the revision number has increased.
+	if revision.NewRevisionNumber <= oldRevision.NewRevisionNumber {
+		return errBadRevisionNumber
+	}
+
+	// Check that the file size and Merkle root match the sector roots that
+	// resulted from applying the renter's modifications.
+	if revision.NewFileSize != uint64(len(so.SectorRoots))*modules.SectorSize {
+		return errBadFileSize
+	}
+	if revision.NewFileMerkleRoot != crypto.CachedMerkleRoot(so.SectorRoots) {
+		return errBadFileMerkleRoot
+	}
+
+	return verifyRevisionPayouts(oldRevision, revision, storageRevenue, bandwidthRevenue, collateralRisked)
+}
+
+// verifyRevisionPayouts checks that a file contract revision drains the
+// renter's valid and missed proof outputs by exactly the revenue that the
+// host is owed for a set of modifications, and correspondingly credits the
+// host's valid output and the host's and void's missed outputs. It is
+// split out from verifyRevision because it operates purely on the old and
+// new revisions, with no storage obligation lookups, which makes it
+// straightforward to exercise directly in tests.
+func verifyRevisionPayouts(oldRevision, revision types.FileContractRevision, storageRevenue, bandwidthRevenue, collateralRisked types.Currency) error {
+	// Check that the renter's outputs have been drained by exactly the
+	// revenue that the host is owed for the modifications it just made. The
+	// renter's committed funds are checked before each subtraction so that a
+	// batch the host should have rejected cannot instead underflow the
+	// Currency type and panic.
+	fromRenter := storageRevenue.Add(bandwidthRevenue)
+	if oldRevision.NewValidProofOutputs[0].Value.Cmp(fromRenter) < 0 {
+		return errRenterValidFundsExhausted
+	}
+	expectedValidRenterOutput := oldRevision.NewValidProofOutputs[0].Value.Sub(fromRenter)
+	if revision.NewValidProofOutputs[0].Value.Cmp(expectedValidRenterOutput) > 0 {
+		return errHighRenterValidOutput
+	}
+	if oldRevision.NewMissedProofOutputs[0].Value.Cmp(fromRenter) < 0 {
+		return errRenterMissedFundsExhausted
+	}
+	expectedMissedRenterOutput := oldRevision.NewMissedProofOutputs[0].Value.Sub(fromRenter)
+	if revision.NewMissedProofOutputs[0].Value.Cmp(expectedMissedRenterOutput) > 0 {
+		return errHighRenterMissedOutput
+	}
+
+	// Check that the host's valid output has increased by the same amount
+	// that was drained from the renter's valid output.
+	expectedValidHostOutput := oldRevision.NewValidProofOutputs[1].Value.Add(fromRenter)
+	if revision.NewValidProofOutputs[1].Value.Cmp(expectedValidHostOutput) < 0 {
+		return errLowHostValidOutput
+	}
+
+	// Check that the collateral the host is risking on this set of
+	// modifications has been moved out of the host's missed output and into
+	// the void's missed output, on top of the revenue that was drained from
+	// the renter's missed output. The host's committed collateral is
+	// checked before the subtraction for the same reason as above:
+	// collateralRisked grows with the host's own collateral rate, which is
+	// unrelated to the renter's remaining funds, so it needs its own guard.
+	if oldRevision.NewMissedProofOutputs[1].Value.Add(fromRenter).Cmp(collateralRisked) < 0 {
+		return errHostCollateralExhausted
+	}
+	expectedMissedHostOutput := oldRevision.NewMissedProofOutputs[1].Value.Add(fromRenter).Sub(collateralRisked)
+	if revision.NewMissedProofOutputs[1].Value.Cmp(expectedMissedHostOutput) < 0 {
+		return errLowHostMissedOutput
+	}
+	expectedVoidOutput := oldRevision.NewMissedProofOutputs[2].Value.Add(collateralRisked)
+	if revision.NewMissedProofOutputs[2].Value.Cmp(expectedVoidOutput) < 0 {
+		return errLowVoidOutput
+	}
 
-	// Check any other thing that needs to be checked.
 	return nil
 }
@@ -0,0 +1,114 @@
+package host
+
+import (
+	"testing"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// revisionWithOutputs builds a minimal FileContractRevision with the given
+// valid and missed proof output values, leaving everything else zeroed. It
+// is a test helper only; verifyRevisionPayouts is the only function under
+// test that looks at just these fields.
+func revisionWithOutputs(validRenter, validHost, missedRenter, missedHost, void uint64) types.FileContractRevision {
+	return types.FileContractRevision{
+		NewValidProofOutputs: []types.SiacoinOutput{
+			{Value: types.NewCurrency64(validRenter)},
+			{Value: types.NewCurrency64(validHost)},
+		},
+		NewMissedProofOutputs: []types.SiacoinOutput{
+			{Value: types.NewCurrency64(missedRenter)},
+			{Value: types.NewCurrency64(missedHost)},
+			{Value: types.NewCurrency64(void)},
+		},
+	}
+}
+
+// TestVerifyRevisionPayoutsAccepts checks that a revision which drains the
+// renter's outputs by exactly the revenue owed, and credits the host's
+// outputs by the same amount, is accepted.
+func TestVerifyRevisionPayoutsAccepts(t *testing.T) {
+	oldRevision := revisionWithOutputs(100, 0, 100, 0, 0)
+	newRevision := revisionWithOutputs(90, 10, 90, 10, 0)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.ZeroCurrency)
+	if err != nil {
+		t.Fatal("expected a well-formed revision to be accepted, got", err)
+	}
+}
+
+// TestVerifyRevisionPayoutsRejectsHighRenterValidOutput checks that a
+// revision is rejected if the renter's valid output was not drained by the
+// revenue the host is owed.
+func TestVerifyRevisionPayoutsRejectsHighRenterValidOutput(t *testing.T) {
+	oldRevision := revisionWithOutputs(100, 0, 100, 0, 0)
+	newRevision := revisionWithOutputs(95, 10, 90, 0, 0)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.ZeroCurrency)
+	if err != errHighRenterValidOutput {
+		t.Fatal("expected errHighRenterValidOutput, got", err)
+	}
+}
+
+// TestVerifyRevisionPayoutsRejectsLowHostValidOutput checks that a revision
+// is rejected if the host's valid output was not credited by the revenue
+// the host is owed.
+func TestVerifyRevisionPayoutsRejectsLowHostValidOutput(t *testing.T) {
+	oldRevision := revisionWithOutputs(100, 0, 100, 0, 0)
+	newRevision := revisionWithOutputs(90, 5, 90, 0, 0)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.ZeroCurrency)
+	if err != errLowHostValidOutput {
+		t.Fatal("expected errLowHostValidOutput, got", err)
+	}
+}
+
+// TestVerifyRevisionPayoutsRejectsLowVoidOutput checks that a revision is
+// rejected if the void output was not credited by the collateral the host
+// is risking.
+func TestVerifyRevisionPayoutsRejectsLowVoidOutput(t *testing.T) {
+	oldRevision := revisionWithOutputs(100, 0, 100, 50, 0)
+	newRevision := revisionWithOutputs(90, 10, 90, 50, 5)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.NewCurrency64(10))
+	if err != errLowVoidOutput {
+		t.Fatal("expected errLowVoidOutput, got", err)
+	}
+}
+
+// TestVerifyRevisionPayoutsRejectsRenterValidFundsExhausted checks that a
+// batch charging the renter more than it has left in its valid proof
+// output is rejected with a typed error instead of underflowing and
+// panicking inside types.Currency.Sub.
+func TestVerifyRevisionPayoutsRejectsRenterValidFundsExhausted(t *testing.T) {
+	oldRevision := revisionWithOutputs(5, 0, 100, 0, 0)
+	newRevision := revisionWithOutputs(0, 10, 90, 10, 0)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.ZeroCurrency)
+	if err != errRenterValidFundsExhausted {
+		t.Fatal("expected errRenterValidFundsExhausted, got", err)
+	}
+}
+
+// TestVerifyRevisionPayoutsRejectsRenterMissedFundsExhausted checks that a
+// batch charging the renter more than it has left in its missed proof
+// output is rejected with a typed error instead of underflowing and
+// panicking inside types.Currency.Sub.
+func TestVerifyRevisionPayoutsRejectsRenterMissedFundsExhausted(t *testing.T) {
+	oldRevision := revisionWithOutputs(100, 0, 5, 0, 0)
+	newRevision := revisionWithOutputs(90, 10, 0, 10, 0)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.ZeroCurrency)
+	if err != errRenterMissedFundsExhausted {
+		t.Fatal("expected errRenterMissedFundsExhausted, got", err)
+	}
+}
+
+// TestVerifyRevisionPayoutsRejectsHostCollateralExhausted checks that a
+// batch risking more collateral than the host has left in its missed
+// proof output is rejected with a typed error instead of underflowing and
+// panicking inside types.Currency.Sub. This covers a host whose
+// collateral rate is at least its storage price, or whose collateral has
+// already been drawn down over prior revisions.
+func TestVerifyRevisionPayoutsRejectsHostCollateralExhausted(t *testing.T) {
+	oldRevision := revisionWithOutputs(100, 0, 100, 5, 0)
+	newRevision := revisionWithOutputs(90, 10, 90, 0, 20)
+	err := verifyRevisionPayouts(oldRevision, newRevision, types.NewCurrency64(10), types.ZeroCurrency, types.NewCurrency64(20))
+	if err != errHostCollateralExhausted {
+		t.Fatal("expected errHostCollateralExhausted, got", err)
+	}
+}